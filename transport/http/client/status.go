@@ -5,10 +5,16 @@ package client
 import (
 	"bytes"
 	"context"
+	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/luraproject/lura/v2/config"
 )
@@ -46,28 +52,285 @@ func NewErrInvalidStatusCode(resp *http.Response, errPrefix string) *ErrInvalidS
 // HTTPStatusHandler defines how we tread the http response code
 type HTTPStatusHandler func(context.Context, *http.Response) (*http.Response, error)
 
-// GetHTTPStatusHandler returns a status handler. If the 'return_error_details' key is defined
-// at the extra config, it returns a DetailedHTTPStatusHandler. Otherwise, it returns a
-// DefaultHTTPStatusHandler
+// statusCodeMatcher reports whether a given status code should be treated as a success
+type statusCodeMatcher func(int) bool
+
+// defaultStatusCodeMatcher is the matcher used when no 'valid_status_codes' key is present:
+// only 200 and 201 are considered successful
+func defaultStatusCodeMatcher(code int) bool {
+	return code == http.StatusOK || code == http.StatusCreated
+}
+
+// errPrefixFor builds the error prefix used to identify the failing endpoint in the classic,
+// non-chained handlers
+func errPrefixFor(remote *config.Backend) string {
+	return fmt.Sprintf("[%s %s]:", remote.Method, remote.URLPattern)
+}
+
+// GetHTTPStatusHandler returns a status handler. If the 'handlers' key is defined at the extra
+// config, it builds a chain out of it: each entry names a registered HTTPStatusHandler (see
+// RegisterHTTPStatusHandler) and, optionally, which status codes it applies to ('codes'
+// and/or 'on', accepting the same explicit-codes-or-ranges syntax as 'valid_status_codes'). The
+// first entry that applies to the received status code decides the outcome; if none applies,
+// the request falls through to the plain 'default' handler.
+//
+// Absent a 'handlers' key, the classic top-level keys ('return_error_details',
+// 'return_error_code', 'valid_status_codes', ...) are translated into an equivalent
+// single-entry chain, so existing configurations keep working unchanged.
 func GetHTTPStatusHandler(remote *config.Backend) HTTPStatusHandler {
-	errPrefix := fmt.Sprintf("[%s %s]:", remote.Method, remote.URLPattern)
+	errPrefix := errPrefixFor(remote)
+
+	m := map[string]interface{}{}
 	if e, ok := remote.ExtraConfig[Namespace]; ok {
-		if m, ok := e.(map[string]interface{}); ok {
-			if v, ok := m["return_error_details"]; ok {
-				if b, ok := v.(string); ok && b != "" {
-					return DetailedHTTPStatusHandlerWithErrPrefix(b, errPrefix)
-				}
-			} else if v, ok := m["return_error_code"].(bool); ok && v {
-				return ErrorHTTPStatusHandlerWithErrPrefix(errPrefix)
+		if mm, ok := e.(map[string]interface{}); ok {
+			m = mm
+		}
+	}
+
+	rawEntries, ok := m["handlers"].([]interface{})
+	if !ok || len(rawEntries) == 0 {
+		rawEntries = legacyHTTPStatusHandlerEntries(m)
+	}
+
+	chain := make([]httpStatusHandlerChainEntry, 0, len(rawEntries))
+	for _, re := range rawEntries {
+		entryCfg, ok := re.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := entryCfg["name"].(string)
+		factory := lookupHTTPStatusHandlerFactory(name)
+		if factory == nil {
+			continue
+		}
+		chain = append(chain, httpStatusHandlerChainEntry{
+			matcher: matcherFromEntry(entryCfg),
+			handler: factory(entryCfg, remote),
+		})
+	}
+
+	return buildHTTPStatusHandlerChain(chain, errPrefix)
+}
+
+// legacyHTTPStatusHandlerEntries translates the pre-registry top-level extra config keys into
+// the equivalent single-entry 'handlers' chain
+func legacyHTTPStatusHandlerEntries(m map[string]interface{}) []interface{} {
+	entry := map[string]interface{}{}
+	for _, k := range []string{"valid_status_codes", "parse_problem_details", "error_body_limit", "conflict_as_already_exists"} {
+		if v, ok := m[k]; ok {
+			entry[k] = v
+		}
+	}
+
+	if v, ok := m["return_error_details"]; ok {
+		if b, ok := v.(string); ok && b != "" {
+			entry["name"] = "detailed"
+			entry["name_field"] = b
+			return []interface{}{entry}
+		}
+	} else if v, ok := m["return_error_code"].(bool); ok && v {
+		entry["name"] = "error"
+		return []interface{}{entry}
+	}
+
+	entry["name"] = "default"
+	return []interface{}{entry}
+}
+
+// httpStatusHandlerChainEntry pairs a handler with the matcher that decides whether it applies
+// to a given status code. A nil matcher always applies.
+type httpStatusHandlerChainEntry struct {
+	matcher statusCodeMatcher
+	handler HTTPStatusHandler
+}
+
+// buildHTTPStatusHandlerChain composes a chain of handlers into a single HTTPStatusHandler: the
+// first entry whose matcher applies to the response decides the outcome, falling back to the
+// plain default handler when none do
+func buildHTTPStatusHandlerChain(chain []httpStatusHandlerChainEntry, errPrefix string) HTTPStatusHandler {
+	fallback := defaultHTTPStatusHandler(errPrefix, nil)
+	return func(ctx context.Context, resp *http.Response) (*http.Response, error) {
+		for _, entry := range chain {
+			if entry.matcher == nil || entry.matcher(resp.StatusCode) {
+				return entry.handler(ctx, resp)
+			}
+		}
+		return fallback(ctx, resp)
+	}
+}
+
+// HTTPStatusHandlerFactory builds a HTTPStatusHandler out of a chain entry's own config (e.g.
+// 'name_field' for the 'detailed' handler) and the backend it is attached to. Registered under
+// a name with RegisterHTTPStatusHandler, to be referenced from the 'handlers' extra config key.
+type HTTPStatusHandlerFactory func(cfg map[string]interface{}, remote *config.Backend) HTTPStatusHandler
+
+var (
+	httpStatusHandlerRegistryMu sync.RWMutex
+	httpStatusHandlerRegistry   = map[string]HTTPStatusHandlerFactory{}
+)
+
+// RegisterHTTPStatusHandler registers a HTTPStatusHandlerFactory under name, so it can be
+// referenced from the 'handlers' extra config key accepted by GetHTTPStatusHandler. Registering
+// under an already-used name replaces the previous factory.
+func RegisterHTTPStatusHandler(name string, factory HTTPStatusHandlerFactory) {
+	httpStatusHandlerRegistryMu.Lock()
+	defer httpStatusHandlerRegistryMu.Unlock()
+	httpStatusHandlerRegistry[name] = factory
+}
+
+func lookupHTTPStatusHandlerFactory(name string) HTTPStatusHandlerFactory {
+	httpStatusHandlerRegistryMu.RLock()
+	defer httpStatusHandlerRegistryMu.RUnlock()
+	return httpStatusHandlerRegistry[name]
+}
+
+func init() {
+	RegisterHTTPStatusHandler("default", func(cfg map[string]interface{}, remote *config.Backend) HTTPStatusHandler {
+		return defaultHTTPStatusHandler(errPrefixFor(remote), statusCodeMatcherFromConfig(cfg))
+	})
+	RegisterHTTPStatusHandler("error", func(cfg map[string]interface{}, remote *config.Backend) HTTPStatusHandler {
+		return errorHTTPStatusHandler(errPrefixFor(remote), statusCodeMatcherFromConfig(cfg), httpResponseErrorOptionsFromConfig(cfg))
+	})
+	RegisterHTTPStatusHandler("detailed", func(cfg map[string]interface{}, remote *config.Backend) HTTPStatusHandler {
+		name, _ := cfg["name_field"].(string)
+		return detailedHTTPStatusHandler(name, errPrefixFor(remote), statusCodeMatcherFromConfig(cfg), httpResponseErrorOptionsFromConfig(cfg))
+	})
+	RegisterHTTPStatusHandler("noop", func(_ map[string]interface{}, _ *config.Backend) HTTPStatusHandler {
+		return NoOpHTTPStatusHandler
+	})
+	// accept_codes always treats the response as a success; it is meant to be combined with
+	// 'codes'/'on' in its chain entry so it only runs for the status codes it should accept
+	RegisterHTTPStatusHandler("accept_codes", func(_ map[string]interface{}, _ *config.Backend) HTTPStatusHandler {
+		return NoOpHTTPStatusHandler
+	})
+}
+
+// statusCodeMatcherFromConfig builds a statusCodeMatcher out of the 'valid_status_codes' key of
+// the extra config, if present. The key accepts a list mixing explicit status codes (numbers)
+// and ranges expressed as strings ("2xx", "200-299", "!=5xx"). It returns nil when the key is
+// absent or does not yield any usable entry, so callers can fall back to the default matcher.
+func statusCodeMatcherFromConfig(cfg map[string]interface{}) statusCodeMatcher {
+	raw, ok := cfg["valid_status_codes"]
+	if !ok {
+		return nil
+	}
+	list, ok := raw.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil
+	}
+	return matcherFromValues(list)
+}
+
+// matcherFromEntry builds a statusCodeMatcher out of a 'handlers' chain entry, merging its
+// 'codes' list (explicit status codes) and its 'on' key (a single range string, or a list
+// mixing codes and ranges). It returns nil, meaning "applies to every status code", when
+// neither key is present or usable.
+func matcherFromEntry(entry map[string]interface{}) statusCodeMatcher {
+	var values []interface{}
+	if codes, ok := entry["codes"].([]interface{}); ok {
+		values = append(values, codes...)
+	}
+	switch on := entry["on"].(type) {
+	case string:
+		values = append(values, on)
+	case []interface{}:
+		values = append(values, on...)
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return matcherFromValues(values)
+}
+
+// matcherFromValues builds a statusCodeMatcher out of a list mixing explicit status codes
+// (numbers) and ranges expressed as strings ("2xx", "200-299", "!=5xx"). It returns nil if none
+// of the values can be parsed.
+func matcherFromValues(list []interface{}) statusCodeMatcher {
+	var codes []int
+	var ranges []func(int) bool
+	for _, v := range list {
+		switch t := v.(type) {
+		case float64:
+			codes = append(codes, int(t))
+		case int:
+			codes = append(codes, t)
+		case string:
+			if r := parseStatusCodeRange(t); r != nil {
+				ranges = append(ranges, r)
+			}
+		}
+	}
+	if len(codes) == 0 && len(ranges) == 0 {
+		return nil
+	}
+
+	return func(code int) bool {
+		for _, c := range codes {
+			if c == code {
+				return true
 			}
 		}
+		for _, r := range ranges {
+			if r(code) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// parseStatusCodeRange turns a string such as "2xx", "200-299" or "!=5xx" into a predicate.
+// It returns nil when the string does not match any of the supported forms.
+func parseStatusCodeRange(s string) func(int) bool {
+	s = strings.TrimSpace(s)
+	negate := strings.HasPrefix(s, "!=")
+	if negate {
+		s = s[2:]
+	}
+
+	var match func(int) bool
+	switch {
+	case len(s) == 3 && strings.HasSuffix(s, "xx"):
+		if s[0] < '1' || s[0] > '9' {
+			return nil
+		}
+		lower := int(s[0]-'0') * 100
+		match = func(code int) bool { return code >= lower && code < lower+100 }
+	case strings.Contains(s, "-"):
+		parts := strings.SplitN(s, "-", 2)
+		lo, errLo := strconv.Atoi(strings.TrimSpace(parts[0]))
+		hi, errHi := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if errLo != nil || errHi != nil || lo > hi {
+			return nil
+		}
+		match = func(code int) bool { return code >= lo && code <= hi }
+	default:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return nil
+		}
+		match = func(code int) bool { return code == n }
+	}
+
+	if negate {
+		inner := match
+		return func(code int) bool { return !inner(code) }
 	}
-	return DefaultHTTPStatusHandlerWithErrPrefix(errPrefix)
+	return match
+}
+
+// isSuccess reports whether resp should be considered a success, falling back to
+// defaultStatusCodeMatcher when no matcher is supplied
+func isSuccess(matcher statusCodeMatcher, resp *http.Response) bool {
+	if matcher == nil {
+		matcher = defaultStatusCodeMatcher
+	}
+	return matcher(resp.StatusCode)
 }
 
 // DefaultHTTPStatusHandler is the default implementation of HTTPStatusHandler
 func DefaultHTTPStatusHandler(_ context.Context, resp *http.Response) (*http.Response, error) {
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+	if !isSuccess(nil, resp) {
 		return nil, ErrInvalidStatusCode
 	}
 
@@ -77,8 +340,12 @@ func DefaultHTTPStatusHandler(_ context.Context, resp *http.Response) (*http.Res
 // DefaultHTTPStatusHandlerWithErrPrefix is the default implementation of HTTPStatusHandler
 // with information about the failing status code, and the failed request
 func DefaultHTTPStatusHandlerWithErrPrefix(errPrefix string) HTTPStatusHandler {
+	return defaultHTTPStatusHandler(errPrefix, nil)
+}
+
+func defaultHTTPStatusHandler(errPrefix string, matcher statusCodeMatcher) HTTPStatusHandler {
 	return func(_ context.Context, resp *http.Response) (*http.Response, error) {
-		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		if !isSuccess(matcher, resp) {
 			return nil, NewErrInvalidStatusCode(resp, errPrefix)
 		}
 		return resp, nil
@@ -90,17 +357,21 @@ func ErrorHTTPStatusHandler(ctx context.Context, resp *http.Response) (*http.Res
 	if _, err := DefaultHTTPStatusHandler(ctx, resp); err == nil {
 		return resp, nil
 	}
-	return resp, newHTTPResponseError(resp)
+	return resp, newHTTPResponseError(resp, defaultHTTPResponseErrorOptions())
 }
 
 // ErrorHTTPStatusHandlerWithErrPrefix is a HTTPStatusHandler that returns the status code as part of the error details
 func ErrorHTTPStatusHandlerWithErrPrefix(errPrefix string) HTTPStatusHandler {
-	defaultH := DefaultHTTPStatusHandlerWithErrPrefix(errPrefix)
+	return errorHTTPStatusHandler(errPrefix, nil, defaultHTTPResponseErrorOptions())
+}
+
+func errorHTTPStatusHandler(errPrefix string, matcher statusCodeMatcher, errOpts httpResponseErrorOptions) HTTPStatusHandler {
+	defaultH := defaultHTTPStatusHandler(errPrefix, matcher)
 	return func(ctx context.Context, resp *http.Response) (*http.Response, error) {
 		if _, err := defaultH(ctx, resp); err == nil {
 			return resp, nil
 		}
-		return resp, newHTTPResponseError(resp)
+		return resp, newHTTPResponseError(resp, errOpts)
 	}
 }
 
@@ -111,48 +382,149 @@ func NoOpHTTPStatusHandler(_ context.Context, resp *http.Response) (*http.Respon
 
 // DetailedHTTPStatusHandler is a HTTPStatusHandler implementation
 func DetailedHTTPStatusHandler(name string) HTTPStatusHandler {
-	return func(ctx context.Context, resp *http.Response) (*http.Response, error) {
-		if _, err := DefaultHTTPStatusHandler(ctx, resp); err == nil {
-			return resp, nil
-		}
-
-		return resp, NamedHTTPResponseError{
-			HTTPResponseError: newHTTPResponseError(resp),
-			name:              name,
-		}
-	}
+	return detailedHTTPStatusHandler(name, "", nil, defaultHTTPResponseErrorOptions())
 }
 
 // DetailedHTTPStatusHandlerWithErrPrefix is a HTTPStatusHandlers that
 // can receive an error prefix to be added when an error happens to help
 // identify the endpoint using this handler.
 func DetailedHTTPStatusHandlerWithErrPrefix(name, errPrefix string) HTTPStatusHandler {
-	defaultH := DefaultHTTPStatusHandlerWithErrPrefix(errPrefix)
+	return detailedHTTPStatusHandler(name, errPrefix, nil, defaultHTTPResponseErrorOptions())
+}
+
+func detailedHTTPStatusHandler(name, errPrefix string, matcher statusCodeMatcher, errOpts httpResponseErrorOptions) HTTPStatusHandler {
+	defaultH := defaultHTTPStatusHandler(errPrefix, matcher)
 	return func(ctx context.Context, resp *http.Response) (*http.Response, error) {
 		if _, err := defaultH(ctx, resp); err == nil {
 			return resp, nil
 		}
 
 		return resp, NamedHTTPResponseError{
-			HTTPResponseError: newHTTPResponseError(resp),
+			HTTPResponseError: newHTTPResponseError(resp, errOpts),
 			name:              name,
 		}
 	}
 }
 
-func newHTTPResponseError(resp *http.Response) HTTPResponseError {
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		body = []byte{}
+// defaultErrorBodyLimit caps the amount of a failing backend's body we buffer in memory,
+// so a megabytes-long or never-ending response can't exhaust the proxy
+const defaultErrorBodyLimit = 4 * 1024
+
+// errBodyPool recycles the buffers used to read the bounded error body, to keep allocation
+// pressure down on the (hopefully rare) error path
+var errBodyPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// truncatedBodyMarker is appended to Msg when the backend body had to be cut at errorBodyLimit
+const truncatedBodyMarker = " ...(truncated)"
+
+// httpResponseErrorOptions controls how newHTTPResponseError processes the failing response
+type httpResponseErrorOptions struct {
+	parseProblemDetails bool
+	errorBodyLimit      int
+	// conflictAsAlreadyExists makes a 409 map to CanonicalCodeAlreadyExists instead of the
+	// default CanonicalCodeAborted
+	conflictAsAlreadyExists bool
+}
+
+// defaultHTTPResponseErrorOptions returns the options used when no extra config is present
+func defaultHTTPResponseErrorOptions() httpResponseErrorOptions {
+	return httpResponseErrorOptions{errorBodyLimit: defaultErrorBodyLimit}
+}
+
+// httpResponseErrorOptionsFromConfig reads the options governing newHTTPResponseError out of
+// the extra config: the opt-in 'parse_problem_details' key, the 'error_body_limit' key and
+// the 'conflict_as_already_exists' key
+func httpResponseErrorOptionsFromConfig(cfg map[string]interface{}) httpResponseErrorOptions {
+	opts := defaultHTTPResponseErrorOptions()
+
+	opts.parseProblemDetails, _ = cfg["parse_problem_details"].(bool)
+	opts.conflictAsAlreadyExists, _ = cfg["conflict_as_already_exists"].(bool)
+
+	if v, ok := cfg["error_body_limit"]; ok {
+		switch t := v.(type) {
+		case float64:
+			opts.errorBodyLimit = int(t)
+		case int:
+			opts.errorBodyLimit = t
+		}
+	}
+
+	return opts
+}
+
+// problemDetailsMediaTypes are the media types defined by RFC 7807 for carrying Problem Details
+var problemDetailsMediaTypes = map[string]bool{
+	"application/problem+json": true,
+	"application/problem+xml":  true,
+}
+
+// ProblemDetails is the structured representation of an RFC 7807 "application/problem+json"
+// (or "+xml") payload
+type ProblemDetails struct {
+	XMLName  xml.Name `json:"-" xml:"problem"`
+	Type     string   `json:"type,omitempty" xml:"type,omitempty"`
+	Title    string   `json:"title,omitempty" xml:"title,omitempty"`
+	Status   int      `json:"status,omitempty" xml:"status,omitempty"`
+	Detail   string   `json:"detail,omitempty" xml:"detail,omitempty"`
+	Instance string   `json:"instance,omitempty" xml:"instance,omitempty"`
+}
+
+func newHTTPResponseError(resp *http.Response, opts httpResponseErrorOptions) HTTPResponseError {
+	limit := opts.errorBodyLimit
+	if limit <= 0 {
+		limit = defaultErrorBodyLimit
 	}
+
+	buf := errBodyPool.Get().(*bytes.Buffer)
+	buf.Reset()
+
+	// read one extra byte so we can tell a body that exactly fills the limit apart from one
+	// that keeps going past it, without ever buffering more than limit+1 bytes
+	n, _ := io.Copy(buf, io.LimitReader(resp.Body, int64(limit)+1))
 	resp.Body.Close()
+
+	truncated := n > int64(limit)
+	data := buf.Bytes()
+	if truncated {
+		data = data[:limit]
+	}
+	body := make([]byte, len(data))
+	copy(body, data)
+	errBodyPool.Put(buf)
+
 	resp.Body = io.NopCloser(bytes.NewBuffer(body))
 
-	return HTTPResponseError{
-		Code: resp.StatusCode,
-		Msg:  string(body),
-		Enc:  resp.Header.Get("Content-Type"),
+	enc := resp.Header.Get("Content-Type")
+	msg := string(body)
+	if truncated {
+		msg += truncatedBodyMarker
+	}
+	e := HTTPResponseError{
+		Code:      resp.StatusCode,
+		Msg:       msg,
+		Enc:       enc,
+		Truncated: truncated,
+		GRPCCode:  canonicalCodeForResponse(resp.StatusCode, opts.conflictAsAlreadyExists),
+	}
+
+	if opts.parseProblemDetails {
+		if mediaType, _, err := mime.ParseMediaType(enc); err == nil && problemDetailsMediaTypes[mediaType] {
+			var problem ProblemDetails
+			var parseErr error
+			if mediaType == "application/problem+xml" {
+				parseErr = xml.Unmarshal(body, &problem)
+			} else {
+				parseErr = json.Unmarshal(body, &problem)
+			}
+			if parseErr == nil {
+				e.ProblemDetail = &problem
+			}
+		}
 	}
+
+	return e
 }
 
 // HTTPResponseError is the error to be returned by the ErrorHTTPStatusHandler
@@ -160,6 +532,16 @@ type HTTPResponseError struct {
 	Code int    `json:"http_status_code"`
 	Msg  string `json:"http_body,omitempty"`
 	Enc  string `json:"http_body_encoding,omitempty"`
+	// ProblemDetail holds the parsed RFC 7807 Problem Details, when 'parse_problem_details'
+	// is enabled and the backend returned a recognized problem payload
+	ProblemDetail *ProblemDetails `json:"problem_details,omitempty"`
+	// Truncated is true when the backend body was longer than the configured
+	// 'error_body_limit' and had to be cut short
+	Truncated bool `json:"truncated,omitempty"`
+	// GRPCCode is the gRPC-style canonical error code for Code, as returned by
+	// CanonicalCodeFromHTTP, except that a 409 maps to CanonicalCodeAlreadyExists when
+	// 'conflict_as_already_exists' is set. Exposed through the CanonicalCode method.
+	GRPCCode string `json:"canonical_code,omitempty"`
 }
 
 // Error returns the error message
@@ -177,6 +559,88 @@ func (r HTTPResponseError) Encoding() string {
 	return r.Enc
 }
 
+// Problem returns the parsed RFC 7807 Problem Details of the response, if any. It is nil
+// unless 'parse_problem_details' was enabled and the backend replied with a recognized
+// "application/problem+json" or "application/problem+xml" payload.
+func (r HTTPResponseError) Problem() *ProblemDetails {
+	return r.ProblemDetail
+}
+
+// CanonicalCode returns the gRPC-style canonical error code for the response, as computed
+// by CanonicalCodeFromHTTP, with 409 mapped to CanonicalCodeAlreadyExists instead when
+// 'conflict_as_already_exists' is set
+func (r HTTPResponseError) CanonicalCode() string {
+	return r.GRPCCode
+}
+
+// The canonical, gRPC-style error codes mirrored by CanonicalCodeFromHTTP. They let callers
+// branch on semantic categories of failure instead of raw HTTP status numbers.
+const (
+	CanonicalCodeOK                 = "OK"
+	CanonicalCodeCanceled           = "Canceled"
+	CanonicalCodeUnknown            = "Unknown"
+	CanonicalCodeInvalidArgument    = "InvalidArgument"
+	CanonicalCodeDeadlineExceeded   = "DeadlineExceeded"
+	CanonicalCodeNotFound           = "NotFound"
+	CanonicalCodeAlreadyExists      = "AlreadyExists"
+	CanonicalCodePermissionDenied   = "PermissionDenied"
+	CanonicalCodeResourceExhausted  = "ResourceExhausted"
+	CanonicalCodeFailedPrecondition = "FailedPrecondition"
+	CanonicalCodeAborted            = "Aborted"
+	CanonicalCodeUnimplemented      = "Unimplemented"
+	CanonicalCodeInternal           = "Internal"
+	CanonicalCodeUnavailable        = "Unavailable"
+	CanonicalCodeDataLoss           = "DataLoss"
+	CanonicalCodeUnauthenticated    = "Unauthenticated"
+)
+
+// CanonicalCodeFromHTTP maps an HTTP status code to its canonical, gRPC-style error code,
+// mirroring the mapping table used by grpc-gateway to translate between the two worlds.
+// Status codes with no well-known counterpart map to CanonicalCodeUnknown.
+func CanonicalCodeFromHTTP(statusCode int) string {
+	switch statusCode {
+	case http.StatusOK:
+		return CanonicalCodeOK
+	case http.StatusBadRequest:
+		return CanonicalCodeInvalidArgument
+	case http.StatusUnauthorized:
+		return CanonicalCodeUnauthenticated
+	case http.StatusForbidden:
+		return CanonicalCodePermissionDenied
+	case http.StatusNotFound:
+		return CanonicalCodeNotFound
+	case http.StatusRequestTimeout:
+		return CanonicalCodeCanceled
+	case http.StatusConflict:
+		return CanonicalCodeAborted
+	case http.StatusPreconditionFailed:
+		return CanonicalCodeFailedPrecondition
+	case http.StatusTooManyRequests:
+		return CanonicalCodeResourceExhausted
+	case 499: // Client Closed Request (nginx)
+		return CanonicalCodeCanceled
+	case http.StatusInternalServerError:
+		return CanonicalCodeInternal
+	case http.StatusNotImplemented:
+		return CanonicalCodeUnimplemented
+	case http.StatusServiceUnavailable:
+		return CanonicalCodeUnavailable
+	case http.StatusGatewayTimeout:
+		return CanonicalCodeDeadlineExceeded
+	default:
+		return CanonicalCodeUnknown
+	}
+}
+
+// canonicalCodeForResponse applies CanonicalCodeFromHTTP, with the 409 -> Aborted/AlreadyExists
+// choice governed by the 'conflict_as_already_exists' extra config key
+func canonicalCodeForResponse(statusCode int, conflictAsAlreadyExists bool) string {
+	if statusCode == http.StatusConflict && conflictAsAlreadyExists {
+		return CanonicalCodeAlreadyExists
+	}
+	return CanonicalCodeFromHTTP(statusCode)
+}
+
 // NamedHTTPResponseError is the error to be returned by the DetailedHTTPStatusHandler
 type NamedHTTPResponseError struct {
 	HTTPResponseError
@@ -0,0 +1,570 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/luraproject/lura/v2/config"
+)
+
+// testResponse builds a response with the given status code and an empty, valid body, so
+// handlers that read resp.Body (e.g. to build a HTTPResponseError) behave as they would against
+// a real backend response
+func testResponse(code int) *http.Response {
+	return &http.Response{
+		StatusCode: code,
+		Body:       io.NopCloser(bytes.NewReader(nil)),
+	}
+}
+
+func TestGetHTTPStatusHandler_Default(t *testing.T) {
+	remote := &config.Backend{Method: "GET", URLPattern: "/"}
+	h := GetHTTPStatusHandler(remote)
+
+	if _, err := h(context.Background(), testResponse(http.StatusOK)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := h(context.Background(), testResponse(http.StatusAccepted)); err == nil {
+		t.Error("expected error for 202 with no valid_status_codes configured")
+	}
+}
+
+func TestGetHTTPStatusHandler_ValidStatusCodes_Explicit(t *testing.T) {
+	remote := &config.Backend{
+		Method:     "GET",
+		URLPattern: "/",
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"valid_status_codes": []interface{}{float64(200), float64(202), float64(204)},
+			},
+		},
+	}
+	h := GetHTTPStatusHandler(remote)
+
+	for _, code := range []int{200, 202, 204} {
+		if _, err := h(context.Background(), testResponse(code)); err != nil {
+			t.Errorf("expected %d to be valid, got error: %v", code, err)
+		}
+	}
+	if _, err := h(context.Background(), testResponse(500)); err == nil {
+		t.Error("expected 500 to be invalid")
+	}
+}
+
+func TestGetHTTPStatusHandler_ValidStatusCodes_Ranges(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		ranges  []interface{}
+		success []int
+		failure []int
+	}{
+		{
+			name:    "2xx",
+			ranges:  []interface{}{"2xx"},
+			success: []int{200, 201, 250, 299},
+			failure: []int{199, 300, 404},
+		},
+		{
+			name:    "explicit range",
+			ranges:  []interface{}{"200-299"},
+			success: []int{200, 299},
+			failure: []int{199, 300},
+		},
+		{
+			name:    "overlapping entries",
+			ranges:  []interface{}{"2xx", float64(304), "200-250"},
+			success: []int{200, 230, 280, 304},
+			failure: []int{305, 404},
+		},
+		{
+			name:    "negated range",
+			ranges:  []interface{}{"!=5xx"},
+			success: []int{200, 404},
+			failure: []int{500, 599},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			remote := &config.Backend{
+				Method:     "GET",
+				URLPattern: "/",
+				ExtraConfig: config.ExtraConfig{
+					Namespace: map[string]interface{}{
+						"valid_status_codes": tc.ranges,
+					},
+				},
+			}
+			h := GetHTTPStatusHandler(remote)
+			for _, code := range tc.success {
+				if _, err := h(context.Background(), testResponse(code)); err != nil {
+					t.Errorf("expected %d to be valid, got error: %v", code, err)
+				}
+			}
+			for _, code := range tc.failure {
+				if _, err := h(context.Background(), testResponse(code)); err == nil {
+					t.Errorf("expected %d to be invalid", code)
+				}
+			}
+		})
+	}
+}
+
+func TestGetHTTPStatusHandler_ValidStatusCodes_Empty(t *testing.T) {
+	remote := &config.Backend{
+		Method:     "GET",
+		URLPattern: "/",
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"valid_status_codes": []interface{}{},
+			},
+		},
+	}
+	h := GetHTTPStatusHandler(remote)
+	if _, err := h(context.Background(), testResponse(http.StatusOK)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := h(context.Background(), testResponse(http.StatusAccepted)); err == nil {
+		t.Error("expected default matcher to apply when valid_status_codes is empty")
+	}
+}
+
+func TestGetHTTPStatusHandler_ValidStatusCodes_Bogus(t *testing.T) {
+	remote := &config.Backend{
+		Method:     "GET",
+		URLPattern: "/",
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"valid_status_codes": []interface{}{"not-a-code", "0xx", "300-", true, nil},
+			},
+		},
+	}
+	h := GetHTTPStatusHandler(remote)
+	if _, err := h(context.Background(), testResponse(http.StatusOK)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := h(context.Background(), testResponse(http.StatusAccepted)); err == nil {
+		t.Error("expected default matcher to apply when every entry is bogus")
+	}
+}
+
+func TestGetHTTPStatusHandler_ValidStatusCodes_SharedWithDetailed(t *testing.T) {
+	remote := &config.Backend{
+		Method:     "GET",
+		URLPattern: "/",
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"return_error_details": "my-backend",
+				"valid_status_codes":   []interface{}{"2xx", float64(202)},
+			},
+		},
+	}
+	h := GetHTTPStatusHandler(remote)
+
+	if _, err := h(context.Background(), testResponse(http.StatusAccepted)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	_, err := h(context.Background(), testResponse(http.StatusInternalServerError))
+	if err == nil {
+		t.Fatal("expected an error for 500")
+	}
+	named, ok := err.(NamedHTTPResponseError)
+	if !ok {
+		t.Fatalf("expected a NamedHTTPResponseError, got %T", err)
+	}
+	if named.Name() != "my-backend" {
+		t.Errorf("unexpected name: %s", named.Name())
+	}
+}
+
+func TestGetHTTPStatusHandler_ValidStatusCodes_SharedWithErrorCode(t *testing.T) {
+	remote := &config.Backend{
+		Method:     "GET",
+		URLPattern: "/",
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"return_error_code":  true,
+				"valid_status_codes": []interface{}{"2xx"},
+			},
+		},
+	}
+	h := GetHTTPStatusHandler(remote)
+
+	if _, err := h(context.Background(), testResponse(http.StatusOK)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	_, err := h(context.Background(), testResponse(http.StatusNotFound))
+	if err == nil {
+		t.Fatal("expected an error for 404")
+	}
+	if _, ok := err.(HTTPResponseError); !ok {
+		t.Errorf("expected a HTTPResponseError, got %T", err)
+	}
+}
+
+func TestGetHTTPStatusHandler_ParseProblemDetails(t *testing.T) {
+	remote := &config.Backend{
+		Method:     "GET",
+		URLPattern: "/",
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"return_error_code":     true,
+				"parse_problem_details": true,
+			},
+		},
+	}
+	h := GetHTTPStatusHandler(remote)
+
+	body := `{"type":"https://example.com/probs/out-of-credit","title":"You do not have enough credit","status":403,"detail":"Your current balance is 30","instance":"/account/12345/msgs/abc"}`
+	resp := &http.Response{
+		StatusCode: http.StatusForbidden,
+		Header:     http.Header{"Content-Type": []string{"application/problem+json; charset=utf-8"}},
+		Body:       io.NopCloser(bytes.NewBufferString(body)),
+	}
+
+	_, err := h(context.Background(), resp)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	httpErr, ok := err.(HTTPResponseError)
+	if !ok {
+		t.Fatalf("expected a HTTPResponseError, got %T", err)
+	}
+	problem := httpErr.Problem()
+	if problem == nil {
+		t.Fatal("expected a parsed Problem")
+	}
+	if problem.Title != "You do not have enough credit" || problem.Status != 403 {
+		t.Errorf("unexpected problem details: %+v", problem)
+	}
+	if httpErr.Msg == "" {
+		t.Error("expected the original body to be preserved in Msg")
+	}
+}
+
+func TestGetHTTPStatusHandler_ParseProblemDetails_OptOut(t *testing.T) {
+	remote := &config.Backend{
+		Method:     "GET",
+		URLPattern: "/",
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"return_error_code": true,
+			},
+		},
+	}
+	h := GetHTTPStatusHandler(remote)
+
+	body := `{"title":"nope","status":500}`
+	resp := &http.Response{
+		StatusCode: http.StatusInternalServerError,
+		Header:     http.Header{"Content-Type": []string{"application/problem+json"}},
+		Body:       io.NopCloser(bytes.NewBufferString(body)),
+	}
+
+	_, err := h(context.Background(), resp)
+	httpErr, ok := err.(HTTPResponseError)
+	if !ok {
+		t.Fatalf("expected a HTTPResponseError, got %T", err)
+	}
+	if httpErr.Problem() != nil {
+		t.Error("expected Problem to stay nil when parse_problem_details is not set")
+	}
+}
+
+func TestGetHTTPStatusHandler_ParseProblemDetails_NonProblemContentType(t *testing.T) {
+	remote := &config.Backend{
+		Method:     "GET",
+		URLPattern: "/",
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"return_error_code":     true,
+				"parse_problem_details": true,
+			},
+		},
+	}
+	h := GetHTTPStatusHandler(remote)
+
+	resp := &http.Response{
+		StatusCode: http.StatusInternalServerError,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(bytes.NewBufferString(`{"title":"nope"}`)),
+	}
+
+	_, err := h(context.Background(), resp)
+	httpErr, ok := err.(HTTPResponseError)
+	if !ok {
+		t.Fatalf("expected a HTTPResponseError, got %T", err)
+	}
+	if httpErr.Problem() != nil {
+		t.Error("expected Problem to stay nil for a non-problem content type")
+	}
+}
+
+func TestGetHTTPStatusHandler_ErrorBodyLimit_Default(t *testing.T) {
+	remote := &config.Backend{
+		Method:     "GET",
+		URLPattern: "/",
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"return_error_code": true,
+			},
+		},
+	}
+	h := GetHTTPStatusHandler(remote)
+
+	huge := bytes.Repeat([]byte("a"), defaultErrorBodyLimit*2)
+	resp := &http.Response{
+		StatusCode: http.StatusInternalServerError,
+		Body:       io.NopCloser(bytes.NewBuffer(huge)),
+	}
+
+	_, err := h(context.Background(), resp)
+	httpErr, ok := err.(HTTPResponseError)
+	if !ok {
+		t.Fatalf("expected a HTTPResponseError, got %T", err)
+	}
+	if !httpErr.Truncated {
+		t.Error("expected Truncated to be true")
+	}
+	if len(httpErr.Msg) <= defaultErrorBodyLimit || len(httpErr.Msg) > defaultErrorBodyLimit+len(truncatedBodyMarker) {
+		t.Errorf("unexpected message length: %d", len(httpErr.Msg))
+	}
+}
+
+func TestGetHTTPStatusHandler_ErrorBodyLimit_Configured(t *testing.T) {
+	remote := &config.Backend{
+		Method:     "GET",
+		URLPattern: "/",
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"return_error_code": true,
+				"error_body_limit":  float64(8),
+			},
+		},
+	}
+	h := GetHTTPStatusHandler(remote)
+
+	resp := &http.Response{
+		StatusCode: http.StatusInternalServerError,
+		Body:       io.NopCloser(bytes.NewBufferString("0123456789")),
+	}
+
+	_, err := h(context.Background(), resp)
+	httpErr, ok := err.(HTTPResponseError)
+	if !ok {
+		t.Fatalf("expected a HTTPResponseError, got %T", err)
+	}
+	if !httpErr.Truncated {
+		t.Error("expected Truncated to be true")
+	}
+
+	body, readErr := io.ReadAll(resp.Body)
+	if readErr != nil {
+		t.Fatalf("unexpected read error: %v", readErr)
+	}
+	if len(body) != 8 {
+		t.Errorf("expected the rebuilt response body to be bounded to 8 bytes, got %d", len(body))
+	}
+}
+
+func TestGetHTTPStatusHandler_ErrorBodyLimit_NoTruncation(t *testing.T) {
+	remote := &config.Backend{
+		Method:     "GET",
+		URLPattern: "/",
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"return_error_code": true,
+			},
+		},
+	}
+	h := GetHTTPStatusHandler(remote)
+
+	resp := &http.Response{
+		StatusCode: http.StatusInternalServerError,
+		Body:       io.NopCloser(bytes.NewBufferString("boom")),
+	}
+
+	_, err := h(context.Background(), resp)
+	httpErr, ok := err.(HTTPResponseError)
+	if !ok {
+		t.Fatalf("expected a HTTPResponseError, got %T", err)
+	}
+	if httpErr.Truncated {
+		t.Error("did not expect Truncated for a short body")
+	}
+	if httpErr.Msg != "boom" {
+		t.Errorf("unexpected message: %q", httpErr.Msg)
+	}
+}
+
+func TestCanonicalCodeFromHTTP(t *testing.T) {
+	for _, tc := range []struct {
+		code int
+		want string
+	}{
+		{http.StatusOK, CanonicalCodeOK},
+		{http.StatusBadRequest, CanonicalCodeInvalidArgument},
+		{http.StatusUnauthorized, CanonicalCodeUnauthenticated},
+		{http.StatusForbidden, CanonicalCodePermissionDenied},
+		{http.StatusNotFound, CanonicalCodeNotFound},
+		{http.StatusRequestTimeout, CanonicalCodeCanceled},
+		{http.StatusConflict, CanonicalCodeAborted},
+		{http.StatusPreconditionFailed, CanonicalCodeFailedPrecondition},
+		{http.StatusTooManyRequests, CanonicalCodeResourceExhausted},
+		{499, CanonicalCodeCanceled},
+		{http.StatusInternalServerError, CanonicalCodeInternal},
+		{http.StatusNotImplemented, CanonicalCodeUnimplemented},
+		{http.StatusServiceUnavailable, CanonicalCodeUnavailable},
+		{http.StatusGatewayTimeout, CanonicalCodeDeadlineExceeded},
+		{http.StatusTeapot, CanonicalCodeUnknown},
+	} {
+		if got := CanonicalCodeFromHTTP(tc.code); got != tc.want {
+			t.Errorf("CanonicalCodeFromHTTP(%d) = %s, want %s", tc.code, got, tc.want)
+		}
+	}
+}
+
+func TestGetHTTPStatusHandler_CanonicalCode(t *testing.T) {
+	remote := &config.Backend{
+		Method:     "GET",
+		URLPattern: "/",
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"return_error_details": "my-backend",
+			},
+		},
+	}
+	h := GetHTTPStatusHandler(remote)
+
+	resp := &http.Response{
+		StatusCode: http.StatusNotFound,
+		Body:       io.NopCloser(bytes.NewBufferString("missing")),
+	}
+
+	_, err := h(context.Background(), resp)
+	named, ok := err.(NamedHTTPResponseError)
+	if !ok {
+		t.Fatalf("expected a NamedHTTPResponseError, got %T", err)
+	}
+	if named.CanonicalCode() != CanonicalCodeNotFound {
+		t.Errorf("unexpected canonical code: %s", named.CanonicalCode())
+	}
+}
+
+func TestGetHTTPStatusHandler_CanonicalCode_ConflictConfigurable(t *testing.T) {
+	remote := &config.Backend{
+		Method:     "GET",
+		URLPattern: "/",
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"return_error_code":          true,
+				"conflict_as_already_exists": true,
+			},
+		},
+	}
+	h := GetHTTPStatusHandler(remote)
+
+	resp := &http.Response{
+		StatusCode: http.StatusConflict,
+		Body:       io.NopCloser(bytes.NewBufferString("conflict")),
+	}
+
+	_, err := h(context.Background(), resp)
+	httpErr, ok := err.(HTTPResponseError)
+	if !ok {
+		t.Fatalf("expected a HTTPResponseError, got %T", err)
+	}
+	if httpErr.CanonicalCode() != CanonicalCodeAlreadyExists {
+		t.Errorf("unexpected canonical code: %s", httpErr.CanonicalCode())
+	}
+}
+
+func TestGetHTTPStatusHandler_HandlerChain_AcceptCodes(t *testing.T) {
+	remote := &config.Backend{
+		Method:     "DELETE",
+		URLPattern: "/resource",
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"handlers": []interface{}{
+					map[string]interface{}{"name": "accept_codes", "codes": []interface{}{float64(404)}},
+					map[string]interface{}{"name": "detailed", "on": "5xx", "name_field": "auth-backend"},
+					map[string]interface{}{"name": "default"},
+				},
+			},
+		},
+	}
+	h := GetHTTPStatusHandler(remote)
+
+	if _, err := h(context.Background(), testResponse(http.StatusNotFound)); err != nil {
+		t.Errorf("expected 404 to be accepted, got: %v", err)
+	}
+
+	_, err := h(context.Background(), &http.Response{
+		StatusCode: http.StatusInternalServerError,
+		Body:       io.NopCloser(bytes.NewBufferString("boom")),
+	})
+	named, ok := err.(NamedHTTPResponseError)
+	if !ok {
+		t.Fatalf("expected a NamedHTTPResponseError for 5xx, got %T", err)
+	}
+	if named.Name() != "auth-backend" {
+		t.Errorf("unexpected name: %s", named.Name())
+	}
+
+	if _, err := h(context.Background(), testResponse(http.StatusOK)); err != nil {
+		t.Errorf("expected 200 to fall through to default, got: %v", err)
+	}
+	if _, err := h(context.Background(), testResponse(http.StatusBadRequest)); err == nil {
+		t.Error("expected 400 to fail via the default fallback entry")
+	}
+}
+
+func TestGetHTTPStatusHandler_HandlerChain_UnknownNameSkipped(t *testing.T) {
+	remote := &config.Backend{
+		Method:     "GET",
+		URLPattern: "/",
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"handlers": []interface{}{
+					map[string]interface{}{"name": "does-not-exist"},
+				},
+			},
+		},
+	}
+	h := GetHTTPStatusHandler(remote)
+
+	if _, err := h(context.Background(), testResponse(http.StatusOK)); err != nil {
+		t.Errorf("expected fallback to default for 200, got: %v", err)
+	}
+	if _, err := h(context.Background(), testResponse(http.StatusTeapot)); err == nil {
+		t.Error("expected fallback to default to reject 418")
+	}
+}
+
+func TestRegisterHTTPStatusHandler_CustomHandler(t *testing.T) {
+	RegisterHTTPStatusHandler("always_ok_test", func(_ map[string]interface{}, _ *config.Backend) HTTPStatusHandler {
+		return NoOpHTTPStatusHandler
+	})
+
+	remote := &config.Backend{
+		Method:     "GET",
+		URLPattern: "/",
+		ExtraConfig: config.ExtraConfig{
+			Namespace: map[string]interface{}{
+				"handlers": []interface{}{
+					map[string]interface{}{"name": "always_ok_test"},
+				},
+			},
+		},
+	}
+	h := GetHTTPStatusHandler(remote)
+
+	if _, err := h(context.Background(), testResponse(http.StatusTeapot)); err != nil {
+		t.Errorf("expected the custom handler to accept everything, got: %v", err)
+	}
+}